@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// slackBlockLimit is the maximum number of blocks in a slack message.
+const slackBlockLimit = 50
+
+// batcher collects the messages for a webhook that arrive within the batch
+// window of each other and queues them as a single slack message.
+type batcher struct {
+	window time.Duration
+	max    int
+
+	mu      sync.Mutex
+	pending map[string]*batch
+	closed  bool
+}
+
+type batch struct {
+	deliveries []delivery
+	timer      *time.Timer
+}
+
+var messageBatcher *batcher
+
+func newBatcher(window time.Duration, max int) *batcher {
+	return &batcher{
+		window:  window,
+		max:     max,
+		pending: make(map[string]*batch),
+	}
+}
+
+// add adds d to the batch of its webhook. Every message restarts the window,
+// a batch that reached the maximum size is queued right away.
+func (b *batcher) add(d delivery) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	pending, ok := b.pending[d.webhookUrl]
+	if !ok {
+		pending = &batch{}
+		pending.timer = time.AfterFunc(b.window, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if !b.closed && b.pending[d.webhookUrl] == pending {
+				b.flush(d.webhookUrl)
+			}
+		})
+		b.pending[d.webhookUrl] = pending
+	} else {
+		pending.timer.Reset(b.window)
+	}
+
+	pending.deliveries = append(pending.deliveries, d)
+	if len(pending.deliveries) >= b.max {
+		b.flush(d.webhookUrl)
+	}
+}
+
+// flush queues the batch of webhookUrl, b.mu must be held.
+func (b *batcher) flush(webhookUrl string) {
+	pending := b.pending[webhookUrl]
+	delete(b.pending, webhookUrl)
+	pending.timer.Stop()
+	enqueue(mergeDeliveries(pending.deliveries))
+}
+
+// close queues all pending batches, nothing may be added afterwards.
+func (b *batcher) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for webhookUrl := range b.pending {
+		b.flush(webhookUrl)
+	}
+	b.closed = true
+}
+
+// mergeDeliveries combines deliveries to the same webhook into one.
+func mergeDeliveries(deliveries []delivery) delivery {
+	if len(deliveries) == 1 {
+		return deliveries[0]
+	}
+
+	var msgs []*ntfyMessage
+	for _, d := range deliveries {
+		msgs = append(msgs, d.msgs...)
+	}
+
+	var payload any
+	switch deliveries[0].payload.(type) {
+	case json.RawMessage:
+		bodies := make([]json.RawMessage, len(deliveries))
+		for i, d := range deliveries {
+			bodies[i] = d.payload.(json.RawMessage)
+		}
+		payload = mergeGenericBodies(bodies)
+	case *discordMessage:
+		messages := make([]*discordMessage, len(deliveries))
+		for i, d := range deliveries {
+			messages[i] = d.payload.(*discordMessage)
+		}
+		payload = mergeDiscordMessages(messages)
+	case *teamsMessageCard:
+		cards := make([]*teamsMessageCard, len(deliveries))
+		for i, d := range deliveries {
+			cards[i] = d.payload.(*teamsMessageCard)
+		}
+		payload = mergeTeamsMessageCards(cards)
+	default:
+		messages := make([]*slackMessage, len(deliveries))
+		for i, d := range deliveries {
+			messages[i] = d.payload.(*slackMessage)
+		}
+		payload = mergeSlackMessages(messages)
+	}
+
+	return delivery{
+		webhookUrl: deliveries[0].webhookUrl,
+		payload:    payload,
+		msgs:       msgs,
+	}
+}
+
+// mergeSlackMessages joins the texts of messages line by line and separates
+// their blocks by dividers.
+func mergeSlackMessages(messages []*slackMessage) *slackMessage {
+	merged := *messages[0]
+	merged.Blocks = nil
+	merged.Attachments = nil
+	var texts []string
+	for i, message := range messages {
+		texts = append(texts, message.Text)
+		if len(message.Blocks) > 0 {
+			if i > 0 {
+				merged.Blocks = append(merged.Blocks, slackBlock{Type: "divider"})
+			}
+			merged.Blocks = append(merged.Blocks, message.Blocks...)
+		}
+		merged.Attachments = append(merged.Attachments, message.Attachments...)
+	}
+	merged.Text = strings.Join(texts, "\n")
+	// the text still contains every message if the blocks had to be cut
+	merged.Blocks = merged.Blocks[:min(len(merged.Blocks), slackBlockLimit)]
+	return &merged
+}
+
+// dispatch hands d to the batcher, or queues it right away if batching is
+// disabled.
+func dispatch(d delivery) {
+	if messageBatcher != nil {
+		messageBatcher.add(d)
+	} else {
+		enqueue(d)
+	}
+}
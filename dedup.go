@@ -0,0 +1,51 @@
+package main
+
+import "time"
+
+// dedupMaxEntries caps the memory used by a dedupCache for very busy topics.
+const dedupMaxEntries = 10000
+
+// dedupCache remembers the ids of forwarded messages for ttl, so messages
+// redelivered by ntfy after a reconnect are only forwarded once.
+type dedupCache struct {
+	ttl  time.Duration
+	seen map[string]time.Time
+}
+
+func newDedupCache(ttl time.Duration) *dedupCache {
+	return &dedupCache{
+		ttl:  ttl,
+		seen: make(map[string]time.Time),
+	}
+}
+
+// check reports whether id was already seen within the ttl and records it
+// as seen at now otherwise.
+func (c *dedupCache) check(id string, now time.Time) bool {
+	if seenAt, ok := c.seen[id]; ok && now.Sub(seenAt) < c.ttl {
+		return true
+	}
+
+	if len(c.seen) >= dedupMaxEntries {
+		c.prune(now)
+	}
+	c.seen[id] = now
+	return false
+}
+
+// prune drops the expired entries, and the oldest ones if that doesn't make
+// room for a new entry.
+func (c *dedupCache) prune(now time.Time) {
+	var oldestId string
+	var oldest time.Time
+	for id, seenAt := range c.seen {
+		if now.Sub(seenAt) >= c.ttl {
+			delete(c.seen, id)
+		} else if oldestId == "" || seenAt.Before(oldest) {
+			oldestId, oldest = id, seenAt
+		}
+	}
+	if len(c.seen) >= dedupMaxEntries {
+		delete(c.seen, oldestId)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// deliveryQueueSize is the number of messages that can wait for delivery
+	// before reading from ntfy pauses.
+	deliveryQueueSize = 1000
+	// deliveryQueueWarning is the queue length from which every further
+	// hundred waiting messages are logged.
+	deliveryQueueWarning = 100
+)
+
+// delivery is a message waiting to be posted to slack, or another --target.
+type delivery struct {
+	webhookUrl string
+	// payload is the json body posted to the webhook.
+	payload any
+	// msgs are the ntfy messages the slack message was built from, more
+	// than one for batches.
+	msgs []*ntfyMessage
+}
+
+var (
+	deliveries chan delivery
+	workers    sync.WaitGroup
+)
+
+// startDelivery starts concurrency workers posting queued messages to slack,
+// all together at most rate messages per second. A rate of 0 disables the
+// limit.
+func startDelivery(concurrency int, rate float64) {
+	deliveries = make(chan delivery, deliveryQueueSize)
+
+	var limiter <-chan time.Time
+	if rate > 0 {
+		limiter = time.NewTicker(time.Duration(float64(time.Second) / rate)).C
+	}
+
+	for range concurrency {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for d := range deliveries {
+				if *dryRun {
+					logDryRun(d)
+					continue
+				}
+				if limiter != nil {
+					<-limiter
+				}
+				err := sendToSlack(d.webhookUrl, d.payload)
+				countPost(err)
+				if err != nil {
+					slog.Error("error sending message", "err", err)
+				} else if *stateFile != "" {
+					saveState(*stateFile, d.msgs[len(d.msgs)-1])
+				}
+			}
+		}()
+	}
+}
+
+// logDryRun logs the json that would be posted for d.
+func logDryRun(d delivery) {
+	body, err := json.Marshal(d.payload)
+	if err != nil {
+		slog.Error("dry run: error encoding message", "err", err)
+		return
+	}
+	slog.Info("dry run: not posting message", "body", string(body))
+}
+
+// stopDelivery waits for the queued messages to be delivered. No messages
+// may be queued afterwards.
+func stopDelivery() {
+	close(deliveries)
+	workers.Wait()
+}
+
+// enqueue queues d for delivery. Messages are never dropped, if the queue is
+// full enqueue blocks until there is room again.
+func enqueue(d delivery) {
+	if queued := len(deliveries); queued >= deliveryQueueWarning && queued%deliveryQueueWarning == 0 {
+		slog.Warn("slack delivery is backing up", "queued", queued)
+	}
+
+	select {
+	case deliveries <- d:
+	default:
+		slog.Warn("slack delivery queue is full, waiting for room", "size", deliveryQueueSize)
+		deliveries <- d
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	// discordTitleLimit and discordDescriptionLimit are the maximum lengths
+	// of the respective embed fields.
+	discordTitleLimit       = 256
+	discordDescriptionLimit = 4096
+	// discordEmbedLimit is the maximum number of embeds in a message.
+	discordEmbedLimit = 10
+)
+
+type discordMessage struct {
+	Username  string         `json:"username,omitempty"`
+	AvatarUrl string         `json:"avatar_url,omitempty"`
+	Embeds    []discordEmbed `json:"embeds"`
+}
+
+type discordEmbed struct {
+	Title       string        `json:"title,omitempty"`
+	Description string        `json:"description"`
+	Url         string        `json:"url,omitempty"`
+	Color       int           `json:"color,omitempty"`
+	Timestamp   string        `json:"timestamp,omitempty"`
+	Image       *discordImage `json:"image,omitempty"`
+}
+
+type discordImage struct {
+	Url string `json:"url"`
+}
+
+// discordEscaper escapes the characters discord uses for markdown formatting.
+var discordEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"*", `\*`,
+	"_", `\_`,
+	"~", `\~`,
+	"`", "\\`",
+	"|", `\|`,
+	">", `\>`,
+)
+
+// newDiscordMessage builds a discord webhook message with a single embed for
+// msg: the title as embed title, the message as description and the
+// priority as color. Discord understands markdown, so markdown messages are
+// sent as is.
+func newDiscordMessage(msg *ntfyMessage) *discordMessage {
+	description := discordEscaper.Replace(msg.Message)
+	if msg.isMarkdown() {
+		description = msg.Message
+	}
+
+	embed := discordEmbed{
+		Title: truncate(msg.Title, discordTitleLimit),
+		Url:   msg.Click,
+	}
+	switch {
+	case msg.Priority >= 5:
+		embed.Color = 0xd00000
+	case msg.Priority == 4:
+		embed.Color = 0xff9900
+	case msg.Priority <= 2:
+		embed.Color = 0x999999
+	}
+	if *timestamp {
+		embed.Timestamp = time.Unix(msg.Time, 0).UTC().Format(time.RFC3339)
+	}
+
+	var footer []string
+	if msg.Attachment != nil && msg.Attachment.Url != "" {
+		if strings.HasPrefix(msg.Attachment.Type, "image/") && *ntfyAuth == "" {
+			embed.Image = &discordImage{Url: msg.Attachment.Url}
+		} else {
+			footer = append(footer, "📎 ["+discordEscaper.Replace(msg.Attachment.Name)+"]("+msg.Attachment.Url+")")
+		}
+	}
+	var actions []string
+	for _, action := range msg.Actions {
+		if (action.Action == "view" || action.Action == "http") && action.Url != "" {
+			actions = append(actions, "["+discordEscaper.Replace(action.Label)+"]("+action.Url+")")
+		}
+	}
+	if len(actions) > 0 {
+		footer = append(footer, strings.Join(actions, " | "))
+	}
+	if !*noTags && len(msg.Tags) > 0 {
+		footer = append(footer, "#"+strings.Join(msg.Tags, " #"))
+	}
+	if len(footer) > 0 {
+		description += "\n" + strings.Join(footer, "\n")
+	}
+	embed.Description = truncate(description, discordDescriptionLimit)
+
+	return &discordMessage{
+		Username:  *slackUsername,
+		AvatarUrl: *slackIconUrl,
+		Embeds:    []discordEmbed{embed},
+	}
+}
+
+// mergeDiscordMessages combines the embeds of messages into one message.
+func mergeDiscordMessages(messages []*discordMessage) *discordMessage {
+	merged := *messages[0]
+	merged.Embeds = nil
+	for _, message := range messages {
+		merged.Embeds = append(merged.Embeds, message.Embeds...)
+	}
+	merged.Embeds = merged.Embeds[:min(len(merged.Embeds), discordEmbedLimit)]
+	return &merged
+}
@@ -0,0 +1,78 @@
+package main
+
+// emojiTags holds the ntfy tags that are rendered as emojis. ntfy accepts any
+// emoji shortcode, this list covers the commonly used ones that slack knows
+// under the same name.
+var emojiTags = map[string]struct{}{
+	"+1":                         {},
+	"-1":                         {},
+	"100":                        {},
+	"alarm_clock":                {},
+	"bangbang":                   {},
+	"bell":                       {},
+	"bomb":                       {},
+	"boom":                       {},
+	"bug":                        {},
+	"calendar":                   {},
+	"chart_with_downwards_trend": {},
+	"chart_with_upwards_trend":   {},
+	"clapper":                    {},
+	"clock3":                     {},
+	"cloud":                      {},
+	"computer":                   {},
+	"construction":               {},
+	"credit_card":                {},
+	"crossed_fingers":            {},
+	"disappointed":               {},
+	"door":                       {},
+	"dvd":                        {},
+	"email":                      {},
+	"exclamation":                {},
+	"eyes":                       {},
+	"file_folder":                {},
+	"fire":                       {},
+	"floppy_disk":                {},
+	"gear":                       {},
+	"ghost":                      {},
+	"globe_with_meridians":       {},
+	"hammer":                     {},
+	"hammer_and_wrench":          {},
+	"heart":                      {},
+	"heavy_check_mark":           {},
+	"hourglass":                  {},
+	"house":                      {},
+	"information_source":         {},
+	"key":                        {},
+	"label":                      {},
+	"loudspeaker":                {},
+	"lock":                       {},
+	"mag":                        {},
+	"mailbox":                    {},
+	"memo":                       {},
+	"money_with_wings":           {},
+	"moneybag":                   {},
+	"no_entry":                   {},
+	"no_entry_sign":              {},
+	"octagonal_sign":             {},
+	"package":                    {},
+	"partying_face":              {},
+	"question":                   {},
+	"rocket":                     {},
+	"rotating_light":             {},
+	"skull":                      {},
+	"slightly_frowning_face":     {},
+	"smile":                      {},
+	"sparkles":                   {},
+	"star":                       {},
+	"stop_sign":                  {},
+	"tada":                       {},
+	"thermometer":                {},
+	"triangular_flag_on_post":    {},
+	"unlock":                     {},
+	"warning":                    {},
+	"wastebasket":                {},
+	"white_check_mark":           {},
+	"wrench":                     {},
+	"x":                          {},
+	"zap":                        {},
+}
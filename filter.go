@@ -0,0 +1,52 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+var (
+	includeRegex *regexp.Regexp
+	excludeRegex *regexp.Regexp
+	requireTags  listFlag
+	dropTags     listFlag
+)
+
+// filterReason returns why msg is not forwarded, or an empty string if it
+// passes all filters.
+func filterReason(msg *ntfyMessage) string {
+	if msg.Priority < *minPriority {
+		return "priority " + strconv.Itoa(msg.Priority) + " is below min-priority"
+	}
+	if includeRegex != nil && !matchesRegex(includeRegex, msg) {
+		return "doesn't match include-regex"
+	}
+	if excludeRegex != nil && matchesRegex(excludeRegex, msg) {
+		return "matches exclude-regex"
+	}
+	for _, tag := range requireTags.values {
+		if !slices.Contains(msg.Tags, tag) {
+			return "missing required tag " + tag
+		}
+	}
+	for _, tag := range dropTags.values {
+		if slices.Contains(msg.Tags, tag) {
+			return "has dropped tag " + tag
+		}
+	}
+	return ""
+}
+
+// matchesRegex reports whether re matches the field of msg selected with
+// --regex-field, for both either the title or the message.
+func matchesRegex(re *regexp.Regexp, msg *ntfyMessage) bool {
+	switch *regexField {
+	case "title":
+		return re.MatchString(msg.Title)
+	case "message":
+		return re.MatchString(msg.Message)
+	default:
+		return re.MatchString(msg.Title) || re.MatchString(msg.Message)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+var (
+	// webhookTemplate renders the body of --target generic messages.
+	webhookTemplate *template.Template
+	webhookHeaders  = http.Header{}
+)
+
+// parseWebhookTemplate parses the body template of the generic target and
+// makes sure it renders valid json.
+func parseWebhookTemplate(source string) (*template.Template, error) {
+	tmpl, err := template.New("webhook").Funcs(template.FuncMap{
+		"json": func(value any) (string, error) {
+			encoded, err := json.Marshal(value)
+			return string(encoded), err
+		},
+	}).Parse(source)
+	if err != nil {
+		return nil, err
+	}
+
+	sample := &ntfyMessage{Id: "sample", Event: "message", Topic: "topic", Title: `"title"`, Message: "line\nline", Priority: defaultPriority, Tags: []string{"tag"}}
+	if _, err := renderWebhookBody(tmpl, sample); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// renderWebhookBody renders the body for msg. The string fields of the message
+// are json escaped, so they can be used in quotes like "{{.Message}}".
+func renderWebhookBody(tmpl *template.Template, msg *ntfyMessage) (json.RawMessage, error) {
+	data := *msg
+	for _, field := range []*string{&data.Id, &data.Event, &data.Topic, &data.Title, &data.Message, &data.Click, &data.ContentType} {
+		*field = jsonEscape(*field)
+	}
+
+	var body strings.Builder
+	if err := tmpl.Execute(&body, &data); err != nil {
+		return nil, err
+	}
+	if !json.Valid([]byte(body.String())) {
+		return nil, errors.New("webhook template didn't render valid json: " + body.String())
+	}
+	return json.RawMessage(body.String()), nil
+}
+
+// jsonEscape escapes value for use inside a json string.
+func jsonEscape(value string) string {
+	encoded, _ := json.Marshal(value)
+	return string(encoded[1 : len(encoded)-1])
+}
+
+// newGenericBody renders the body of msg for the generic target. A message
+// the template can't be rendered for is sent as the raw ntfy message.
+func newGenericBody(msg *ntfyMessage) json.RawMessage {
+	body, err := renderWebhookBody(webhookTemplate, msg)
+	if err != nil {
+		slog.Warn("error rendering webhook template, sending the ntfy message", "id", msg.Id, "err", err)
+		body, _ = json.Marshal(msg)
+	}
+	return body
+}
+
+// mergeGenericBodies combines bodies into a json array.
+func mergeGenericBodies(bodies []json.RawMessage) json.RawMessage {
+	merged, _ := json.Marshal(bodies)
+	return merged
+}
+
+// parseHeader parses a header in the form "Name: Value".
+func parseHeader(header string) (string, string, error) {
+	name, value, ok := strings.Cut(header, ":")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		return "", "", errors.New("invalid header, expected Name: Value")
+	}
+	return http.CanonicalHeaderKey(name), value, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// ready is set while the subscription to ntfy is established.
+var ready atomic.Bool
+
+// registerHealthHandlers adds /healthz, reporting that the process is alive,
+// and /readyz, reporting whether ntfy-to-slack is currently connected to
+// ntfy, to mux.
+func registerHealthHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			http.Error(w, "not connected to ntfy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// serve starts serving mux on addr in the background.
+func serve(addr string, mux *http.ServeMux) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			slog.Error("http server stopped", "addr", addr, "err", err)
+		}
+	}()
+	slog.Info("serving http", "addr", listener.Addr().String())
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// metrics are exposed in the prometheus text format by the --metrics-addr
+// server. They are counted whether or not the server runs.
+var metrics = struct {
+	mu       sync.Mutex
+	received map[string]uint64
+
+	postsSucceeded atomic.Uint64
+	postsFailed    atomic.Uint64
+	reconnects     atomic.Uint64
+}{
+	received: make(map[string]uint64),
+}
+
+// countReceived counts a line received from ntfy by its event type.
+func countReceived(event string) {
+	switch event {
+	case "open", "keepalive", "message", "poll_request":
+	default:
+		// keep the number of label values bounded
+		event = "other"
+	}
+	metrics.mu.Lock()
+	metrics.received[event]++
+	metrics.mu.Unlock()
+}
+
+func countPost(err error) {
+	if err != nil {
+		metrics.postsFailed.Add(1)
+	} else {
+		metrics.postsSucceeded.Add(1)
+	}
+}
+
+// registerMetricsHandler adds the /metrics endpoint to mux.
+func registerMetricsHandler(mux *http.ServeMux) {
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		fmt.Fprintln(w, "# HELP ntfy_to_slack_ntfy_messages_received_total Lines received from ntfy by event type.")
+		fmt.Fprintln(w, "# TYPE ntfy_to_slack_ntfy_messages_received_total counter")
+		metrics.mu.Lock()
+		events := make([]string, 0, len(metrics.received))
+		for event := range metrics.received {
+			events = append(events, event)
+		}
+		sort.Strings(events)
+		for _, event := range events {
+			fmt.Fprintf(w, "ntfy_to_slack_ntfy_messages_received_total{event=%q} %d\n", event, metrics.received[event])
+		}
+		metrics.mu.Unlock()
+
+		fmt.Fprintln(w, "# HELP ntfy_to_slack_posts_total Messages posted to the webhook by result.")
+		fmt.Fprintln(w, "# TYPE ntfy_to_slack_posts_total counter")
+		fmt.Fprintf(w, "ntfy_to_slack_posts_total{result=\"success\"} %d\n", metrics.postsSucceeded.Load())
+		fmt.Fprintf(w, "ntfy_to_slack_posts_total{result=\"failure\"} %d\n", metrics.postsFailed.Load())
+
+		fmt.Fprintln(w, "# HELP ntfy_to_slack_reconnects_total Reconnects to ntfy after the subscription failed or was closed.")
+		fmt.Fprintln(w, "# TYPE ntfy_to_slack_reconnects_total counter")
+		fmt.Fprintf(w, "ntfy_to_slack_reconnects_total %d\n", metrics.reconnects.Load())
+
+		fmt.Fprintln(w, "# HELP ntfy_to_slack_connected Whether the subscription to ntfy is currently established.")
+		fmt.Fprintln(w, "# TYPE ntfy_to_slack_connected gauge")
+		connected := 0
+		if ready.Load() {
+			connected = 1
+		}
+		fmt.Fprintf(w, "ntfy_to_slack_connected %d\n", connected)
+	})
+}
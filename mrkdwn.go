@@ -0,0 +1,76 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	markdownHeading = regexp.MustCompile(`^#{1,6}\s+(.*?)\s*#*$`)
+	markdownBullet  = regexp.MustCompile(`^(\s*)[-*+]\s+`)
+	markdownLink    = regexp.MustCompile(`!?\[([^\]]*)\]\(([^)\s]+)\)`)
+	markdownBold    = regexp.MustCompile(`\*\*(\S(?:.*?\S)?)\*\*|__(\S(?:.*?\S)?)__`)
+	markdownItalic  = regexp.MustCompile(`\*(\S(?:.*?\S)?)\*`)
+	markdownStrike  = regexp.MustCompile(`~~(\S(?:.*?\S)?)~~`)
+)
+
+// mrkdwnEscaper neutralizes the characters slack uses for formatting by
+// following them with a zero width space, slack has no other way to escape
+// them.
+var mrkdwnEscaper = strings.NewReplacer(
+	"*", "*\u200b",
+	"_", "_\u200b",
+	"~", "~\u200b",
+	"`", "`\u200b",
+)
+
+// escapeMrkdwn makes sure plain text shows up in slack as is, instead of
+// stray asterisks or underscores turning parts of it bold or italic.
+func escapeMrkdwn(text string) string {
+	return mrkdwnEscaper.Replace(text)
+}
+
+// markdownToMrkdwn converts the commonly used parts of markdown to slack's
+// mrkdwn: emphasis, strikethrough, links, headings and lists. Code spans and
+// blocks use the same syntax in both and are left untouched.
+func markdownToMrkdwn(markdown string) string {
+	lines := strings.Split(markdown, "\n")
+	inCodeBlock := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inCodeBlock = !inCodeBlock
+			continue
+		}
+		if inCodeBlock {
+			continue
+		}
+
+		if heading := markdownHeading.FindStringSubmatch(line); heading != nil {
+			line = "**" + heading[1] + "**"
+		}
+		line = markdownBullet.ReplaceAllString(line, "$1• ")
+
+		// every odd part is a code span, except for the rest of the line
+		// after an unmatched backtick
+		parts := strings.Split(line, "`")
+		for j := range parts {
+			if j%2 == 0 || j == len(parts)-1 {
+				parts[j] = convertInline(parts[j])
+			}
+		}
+		lines[i] = strings.Join(parts, "`")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// convertInline converts the inline formatting of a line fragment without
+// code spans.
+func convertInline(text string) string {
+	text = markdownLink.ReplaceAllString(text, "<$2|$1>")
+	// bold is swapped to a placeholder first, so the single asterisks of the
+	// result aren't taken for italic afterwards
+	text = markdownBold.ReplaceAllString(text, "\x00$1$2\x00")
+	text = markdownItalic.ReplaceAllString(text, "_${1}_")
+	text = markdownStrike.ReplaceAllString(text, "~$1~")
+	return strings.ReplaceAll(text, "\x00", "*")
+}
@@ -2,42 +2,151 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"flag"
-	"io"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 )
 
 const (
 	version            = "v1.3 2024-07-04"
 	upstreamNtfyServer = "ntfy.sh"
+	// defaultPriority is what ntfy assumes when a message has no priority.
+	defaultPriority = 3
+	// stableConnection is how long a subscription has to stay up for the
+	// reconnect backoff to start over at --reconnect-min.
+	stableConnection = time.Minute
+	// shutdownTimeout bounds how long a message that is being forwarded
+	// may delay the shutdown.
+	shutdownTimeout = 10 * time.Second
 )
 
 var (
-	defaultNtfyDomain = upstreamNtfyServer
-	ntfyDomain        *string
-	ntfyTopic         *string
-	ntfyAuth          *string
-	slackWebhookUrl   *string
+	defaultNtfyDomain   = upstreamNtfyServer
+	ntfyDomain          *string
+	ntfyTopic           *string
+	ntfyTopics          []string
+	ntfyAuth            *string
+	ntfyUser            *string
+	ntfyPass            *string
+	ntfyInsecure        *bool
+	ntfyCaCert          *string
+	ntfyClient          *http.Client
+	ntfySince           *string
+	pollInterval        *time.Duration
+	ntfyTransport       *string
+	reconnectMin        *time.Duration
+	reconnectMax        *time.Duration
+	readTimeout         *time.Duration
+	minPriority         *int
+	regexField          *string
+	dedupTtl            *time.Duration
+	dedup               *dedupCache
+	noTags              *bool
+	clickLabel          *string
+	slackFormat         *string
+	templateText        *string
+	slackChannel        *string
+	slackUsername       *string
+	slackIconEmoji      *string
+	slackIconUrl        *string
+	timestamp           *bool
+	timezone            *string
+	location            *time.Location
+	slackWebhookUrl     *string
+	target              *string
+	webhookTemplateText *string
+	slackRoutes         = map[string]string{}
+	slackRetries        *int
+	slackRate           *float64
+	slackConcurrency    *int
+	batchWindow         *time.Duration
+	batchMax            *int
+	healthAddr          *string
+	metricsAddr         *string
+	dryRun              *bool
+	stateFile           *string
+	resume              resumePoint
+	startTime           = time.Now()
 )
 
 type ntfyMessage struct {
-	Id      string
-	Time    int64
-	Event   string
-	Topic   string
-	Title   string
-	Message string
+	Id         string
+	Time       int64
+	Event      string
+	Topic      string
+	Title      string
+	Message    string
+	Priority   int
+	Tags       []string
+	Click      string
+	Attachment *ntfyAttachment
+	Actions    []ntfyAction
+	// ContentType is text/markdown for messages published with markdown
+	// enabled.
+	ContentType string `json:"content_type"`
 }
 
-type slackMessage struct {
-	Text string `json:"text"`
+func (m *ntfyMessage) isMarkdown() bool {
+	return m.ContentType == "text/markdown"
+}
+
+// ntfyAction is a user action attached to a message. Only the fields needed
+// to render view and http actions as links are parsed.
+type ntfyAction struct {
+	Action string
+	Label  string
+	Url    string
+}
+
+type ntfyAttachment struct {
+	Name    string
+	Type    string
+	Size    int64
+	Expires int64
+	Url     string
+}
+
+// resumePoint remembers the newest message seen on the subscription, so that
+// a reconnect can ask ntfy for everything published since then.
+type resumePoint struct {
+	time int64
+	// ids holds the messages seen at exactly time. ntfy treats since=<time>
+	// inclusively, so these are redelivered after a reconnect.
+	ids map[string]struct{}
+}
+
+func (r *resumePoint) seen(msg *ntfyMessage) bool {
+	if msg.Time < r.time {
+		return true
+	}
+	_, ok := r.ids[msg.Id]
+	return msg.Time == r.time && ok
+}
+
+func (r *resumePoint) update(msg *ntfyMessage) {
+	if msg.Time > r.time {
+		r.time = msg.Time
+		r.ids = make(map[string]struct{})
+	}
+	if msg.Time == r.time {
+		r.ids[msg.Id] = struct{}{}
+	}
 }
 
 func main() {
@@ -62,12 +171,121 @@ func main() {
 	}
 	envNtfyTopic, _ := os.LookupEnv("NTFY_TOPIC")
 	envNtfyAuth, _ := os.LookupEnv("NTFY_AUTH")
+	envNtfyUser, _ := os.LookupEnv("NTFY_USER")
+	envNtfyPass, _ := os.LookupEnv("NTFY_PASS")
+	envNtfyInsecure := lookupEnvBool("NTFY_INSECURE", false)
+	envNtfyCaCert, _ := os.LookupEnv("NTFY_CA_CERT")
+	envNtfySince, _ := os.LookupEnv("NTFY_SINCE")
+	envPollInterval := lookupEnvDuration("NTFY_POLL_INTERVAL", 0)
+	envNtfyTransport, ok := os.LookupEnv("NTFY_TRANSPORT")
+	if !ok {
+		envNtfyTransport = "http"
+	}
+	envReconnectMin := lookupEnvDuration("NTFY_RECONNECT_MIN", time.Second)
+	envReconnectMax := lookupEnvDuration("NTFY_RECONNECT_MAX", 5*time.Minute)
+	// ntfy sends a keepalive every 45s by default, allow missing two of them.
+	envReadTimeout := lookupEnvDuration("NTFY_READ_TIMEOUT", 3*45*time.Second)
+	envIncludeRegex, _ := os.LookupEnv("INCLUDE_REGEX")
+	envExcludeRegex, _ := os.LookupEnv("EXCLUDE_REGEX")
+	envRegexField, ok := os.LookupEnv("REGEX_FIELD")
+	if !ok {
+		envRegexField = "both"
+	}
+	envDedupTtl := lookupEnvDuration("DEDUP_TTL", time.Hour)
+	envMinPriority := lookupEnvInt("NTFY_MIN_PRIORITY", 1)
+	envNoTags := lookupEnvBool("NO_TAGS", false)
+	envClickLabel, ok := os.LookupEnv("CLICK_LABEL")
+	if !ok {
+		envClickLabel = "Open"
+	}
 	envSlackWebhookUrl, _ := os.LookupEnv("SLACK_WEBHOOK_URL")
+	envHealthAddr, _ := os.LookupEnv("HEALTH_ADDR")
+	envMetricsAddr, _ := os.LookupEnv("METRICS_ADDR")
+	envDryRun := lookupEnvBool("DRY_RUN", false)
+	envStateFile, _ := os.LookupEnv("STATE_FILE")
+	envWebhookTemplate, _ := os.LookupEnv("WEBHOOK_TEMPLATE")
+	envTarget, ok := os.LookupEnv("TARGET")
+	if !ok {
+		envTarget = "slack"
+	}
+	envTemplate, _ := os.LookupEnv("TEMPLATE")
+	envSlackChannel, _ := os.LookupEnv("SLACK_CHANNEL")
+	envSlackUsername, _ := os.LookupEnv("SLACK_USERNAME")
+	envSlackIconEmoji, _ := os.LookupEnv("SLACK_ICON_EMOJI")
+	envSlackIconUrl, _ := os.LookupEnv("SLACK_ICON_URL")
+	envTimestamp := lookupEnvBool("TIMESTAMP", false)
+	envTimezone, ok := os.LookupEnv("TIMEZONE")
+	if !ok {
+		envTimezone = "UTC"
+	}
+	envSlackRetries := lookupEnvInt("SLACK_RETRIES", 3)
+	envSlackRate := lookupEnvFloat("SLACK_RATE", 0)
+	envSlackConcurrency := lookupEnvInt("SLACK_CONCURRENCY", 1)
+	envBatchWindow := lookupEnvDuration("BATCH_WINDOW", 0)
+	envBatchMax := lookupEnvInt("BATCH_MAX", 10)
+	envSlackFormat, ok := os.LookupEnv("SLACK_FORMAT")
+	if !ok {
+		envSlackFormat = "text"
+	}
 
-	ntfyDomain = flag.String("ntfy-domain", defaultNtfyDomain, "Choose the ntfy server to interact with.\nDefaults to "+upstreamNtfyServer+" or the value of the NTFY_DOMAIN env var, if it is set")
-	ntfyTopic = flag.String("ntfy-topic", envNtfyTopic, "Choose the ntfy topic to interact with\nDefaults to the value of the NTFY_TOPIC env var, if it is set")
+	ntfyDomain = flag.String("ntfy-domain", defaultNtfyDomain, "Choose the ntfy server to interact with, either a domain or a url like http://localhost:2586 for servers without TLS.\nDefaults to "+upstreamNtfyServer+" or the value of the NTFY_DOMAIN env var, if it is set")
+	ntfyTopic = flag.String("ntfy-topic", envNtfyTopic, "Choose the ntfy topic to interact with, multiple topics can be separated by commas\nDefaults to the value of the NTFY_TOPIC env var, if it is set")
 	ntfyAuth = flag.String("ntfy-auth", envNtfyAuth, "Specify token for reserved topics")
+	ntfyUser = flag.String("ntfy-user", envNtfyUser, "Specify username for reserved topics, used with basic auth instead of a token\nDefaults to the value of the NTFY_USER env var, if it is set")
+	ntfyPass = flag.String("ntfy-pass", envNtfyPass, "Specify password for reserved topics, used with basic auth instead of a token\nDefaults to the value of the NTFY_PASS env var, if it is set")
+	ntfyInsecure = flag.Bool("ntfy-insecure", envNtfyInsecure, "Don't verify the TLS certificate of the ntfy server, this allows anyone on the network path to read and forge messages\nDefaults to the value of the NTFY_INSECURE env var, if it is set")
+	ntfyCaCert = flag.String("ntfy-ca-cert", envNtfyCaCert, "Path to a PEM file with additional CA certificates to trust for the ntfy server\nDefaults to the value of the NTFY_CA_CERT env var, if it is set")
+	ntfySince = flag.String("ntfy-since", envNtfySince, "Replay messages published since the given value on the first connection: all, a duration like 10m or a unix timestamp\nDefaults to the value of the NTFY_SINCE env var, if it is set")
+	pollInterval = flag.Duration("poll-interval", envPollInterval, "Poll ntfy on the given interval instead of keeping a long-lived connection open, e.g. 1m\nDefaults to the value of the NTFY_POLL_INTERVAL env var, if it is set")
+	ntfyTransport = flag.String("ntfy-transport", envNtfyTransport, "Subscribe over a streaming http connection (http) or a websocket (ws)\nDefaults to http or the value of the NTFY_TRANSPORT env var, if it is set")
+	reconnectMin = flag.Duration("reconnect-min", envReconnectMin, "Delay before the first reconnect attempt, doubled after every failed attempt\nDefaults to 1s or the value of the NTFY_RECONNECT_MIN env var, if it is set")
+	reconnectMax = flag.Duration("reconnect-max", envReconnectMax, "Upper bound for the delay between reconnect attempts\nDefaults to 5m or the value of the NTFY_RECONNECT_MAX env var, if it is set")
+	readTimeout = flag.Duration("read-timeout", envReadTimeout, "Reconnect if nothing, not even a keepalive, was received from ntfy for this long, 0 disables the timeout\nDefaults to 2m15s or the value of the NTFY_READ_TIMEOUT env var, if it is set")
+	dedupTtl = flag.Duration("dedup-ttl", envDedupTtl, "Forward a message id only once within this duration, 0 disables deduplication\nDefaults to 1h or the value of the DEDUP_TTL env var, if it is set")
+	includeRegexText := flag.String("include-regex", envIncludeRegex, "Only forward messages matching this regular expression\nDefaults to the value of the INCLUDE_REGEX env var, if it is set")
+	excludeRegexText := flag.String("exclude-regex", envExcludeRegex, "Don't forward messages matching this regular expression\nDefaults to the value of the EXCLUDE_REGEX env var, if it is set")
+	regexField = flag.String("regex-field", envRegexField, "What include-regex and exclude-regex are matched against: title, message or both, matching if either matches\nDefaults to both or the value of the REGEX_FIELD env var, if it is set")
+	if envRequireTags, ok := os.LookupEnv("REQUIRE_TAGS"); ok {
+		requireTags.values = splitList(envRequireTags)
+	}
+	flag.Var(&requireTags, "require-tag", "Only forward messages carrying this tag, can be repeated to require all of the tags\nDefaults to the comma separated value of the REQUIRE_TAGS env var, if it is set")
+	if envDropTags, ok := os.LookupEnv("DROP_TAGS"); ok {
+		dropTags.values = splitList(envDropTags)
+	}
+	flag.Var(&dropTags, "drop-tag", "Don't forward messages carrying this tag, can be repeated\nDefaults to the comma separated value of the DROP_TAGS env var, if it is set")
+	minPriority = flag.Int("min-priority", envMinPriority, "Drop messages with a priority below this value (1-5)\nDefaults to the value of the NTFY_MIN_PRIORITY env var, if it is set")
+	noTags = flag.Bool("no-tags", envNoTags, "Don't render ntfy tags as emojis and hashtags\nDefaults to the value of the NO_TAGS env var, if it is set")
+	clickLabel = flag.String("click-label", envClickLabel, "Text of the link to the click url of a message\nDefaults to Open or the value of the CLICK_LABEL env var, if it is set")
 	slackWebhookUrl = flag.String("slack-webhook", envSlackWebhookUrl, "Choose the slack webhook url to send messages to\nDefaults to the value of the SLACK_WEBHOOK_URL env var, if it is set")
+	target = flag.String("target", envTarget, "Kind of webhook messages are sent to, either slack, discord, teams or generic\nDefaults to slack or the value of the TARGET env var, if it is set")
+	webhookTemplateText = flag.String("webhook-template", envWebhookTemplate, "Go text/template rendering the json body of generic target messages, like {\"msg\":\"{{.Message}}\"}\nDefaults to the value of the WEBHOOK_TEMPLATE env var, if it is set")
+	var headers listFlag
+	if envHeaders, ok := os.LookupEnv("WEBHOOK_HEADERS"); ok {
+		headers.values = strings.Split(envHeaders, ",")
+	}
+	flag.Var(&headers, "webhook-header", "Header added to generic target requests, as Name: Value, can be repeated\nDefaults to the comma separated value of the WEBHOOK_HEADERS env var, if it is set")
+	slackRetries = flag.Int("slack-retries", envSlackRetries, "How often to retry a message that slack rejected because of rate limiting\nDefaults to 3 or the value of the SLACK_RETRIES env var, if it is set")
+	slackRate = flag.Float64("slack-rate", envSlackRate, "Post at most this many messages per second to slack, further messages are queued, 0 disables the limit\nDefaults to the value of the SLACK_RATE env var, if it is set")
+	slackConcurrency = flag.Int("slack-concurrency", envSlackConcurrency, "Number of messages posted to slack in parallel, messages may arrive out of order if greater than 1\nDefaults to 1 or the value of the SLACK_CONCURRENCY env var, if it is set")
+	batchWindow = flag.Duration("batch-window", envBatchWindow, "Combine messages arriving within this duration of each other into one slack message, 0 disables batching\nDefaults to the value of the BATCH_WINDOW env var, if it is set")
+	batchMax = flag.Int("batch-max", envBatchMax, "Maximum number of messages combined into one slack message\nDefaults to 10 or the value of the BATCH_MAX env var, if it is set")
+	slackFormat = flag.String("slack-format", envSlackFormat, "Layout of the slack messages, either text, blocks for a Block Kit layout or attachment for a color bar by priority\nDefaults to text or the value of the SLACK_FORMAT env var, if it is set")
+	templateText = flag.String("template", envTemplate, "Go text/template rendering the slack text from the ntfy message, like {{.Title}} - {{.Message}}\nDefaults to "+defaultTemplate+" or the value of the TEMPLATE env var, if it is set")
+	slackChannel = flag.String("slack-channel", envSlackChannel, "Post to this channel instead of the default channel of the webhook\nDefaults to the value of the SLACK_CHANNEL env var, if it is set")
+	slackUsername = flag.String("slack-username", envSlackUsername, "Post with this username instead of the default of the webhook\nDefaults to the value of the SLACK_USERNAME env var, if it is set")
+	slackIconEmoji = flag.String("slack-icon-emoji", envSlackIconEmoji, "Post with this emoji, like :bell:, as icon\nDefaults to the value of the SLACK_ICON_EMOJI env var, if it is set")
+	slackIconUrl = flag.String("slack-icon-url", envSlackIconUrl, "Post with the image at this url as icon\nDefaults to the value of the SLACK_ICON_URL env var, if it is set")
+	timestamp = flag.Bool("timestamp", envTimestamp, "Add the time a message was sent to the slack message\nDefaults to the value of the TIMESTAMP env var, if it is set")
+	timezone = flag.String("timezone", envTimezone, "Time zone to display the time of a message in, like Europe/Berlin\nDefaults to UTC or the value of the TIMEZONE env var, if it is set")
+	var routes listFlag
+	if envRoutes, ok := os.LookupEnv("SLACK_ROUTES"); ok {
+		routes.values = strings.Split(envRoutes, ",")
+	}
+	flag.Var(&routes, "route", "Send messages of a topic to another webhook, as topic=url, can be repeated\nDefaults to the comma separated value of the SLACK_ROUTES env var, if it is set")
+	healthAddr = flag.String("health-addr", envHealthAddr, "Serve /healthz and /readyz health checks on this address, like :8080\nDefaults to the value of the HEALTH_ADDR env var, if it is set")
+	metricsAddr = flag.String("metrics-addr", envMetricsAddr, "Serve prometheus metrics at /metrics on this address, like :9090, may be the same as health-addr\nDefaults to the value of the METRICS_ADDR env var, if it is set")
+	dryRun = flag.Bool("dry-run", envDryRun, "Log the json that would be posted instead of posting it, filters, deduplication and formatting still apply\nDefaults to the value of the DRY_RUN env var, if it is set")
+	stateFile = flag.String("state-file", envStateFile, "Store the last forwarded message in this file and resume from it after a restart\nDefaults to the value of the STATE_FILE env var, if it is set")
 	versionFlag := flag.Bool("v", false, "prints current ntfy-to-slack version")
 
 	flag.Parse()
@@ -77,43 +295,525 @@ func main() {
 		os.Exit(0)
 	}
 
+	ntfyTopics = splitList(*ntfyTopic)
+
+	for _, route := range routes.values {
+		topic, webhookUrl, ok := strings.Cut(route, "=")
+		topic, webhookUrl = strings.TrimSpace(topic), strings.TrimSpace(webhookUrl)
+		if !ok || topic == "" || webhookUrl == "" {
+			slog.Error("invalid route, expected topic=url", "route", route)
+			os.Exit(2)
+		}
+		if _, ok := slackRoutes[topic]; ok {
+			slog.Warn("topic is routed more than once, using the last route", "topic", topic)
+		}
+		slackRoutes[topic] = webhookUrl
+	}
+
+	if err := validateRequired(); err != nil {
+		slog.Error("invalid configuration", "err", err)
+		os.Exit(2)
+	}
+
+	if *ntfyAuth != "" && (*ntfyUser != "" || *ntfyPass != "") {
+		slog.Error("ntfy-auth can't be combined with ntfy-user and ntfy-pass, choose either token or basic auth")
+		os.Exit(2)
+	}
+
+	var err error
+	if *regexField != "title" && *regexField != "message" && *regexField != "both" {
+		slog.Error("invalid regex-field, expected title, message or both", "value", *regexField)
+		os.Exit(2)
+	}
+	if *includeRegexText != "" {
+		if includeRegex, err = regexp.Compile(*includeRegexText); err != nil {
+			slog.Error("invalid include-regex", "err", err)
+			os.Exit(2)
+		}
+	}
+	if *excludeRegexText != "" {
+		if excludeRegex, err = regexp.Compile(*excludeRegexText); err != nil {
+			slog.Error("invalid exclude-regex", "err", err)
+			os.Exit(2)
+		}
+	}
+
+	if *minPriority < 1 || *minPriority > 5 {
+		slog.Error("invalid min-priority, expected a value between 1 and 5", "value", *minPriority)
+		os.Exit(2)
+	}
+
+	if err := validateSince(*ntfySince); err != nil {
+		slog.Error("invalid ntfy-since", "value", *ntfySince, "err", err)
+		os.Exit(2)
+	}
+
+	switch *target {
+	case "slack", "discord", "teams":
+	case "generic":
+		if *webhookTemplateText == "" {
+			slog.Error("the generic target requires a webhook-template")
+			os.Exit(2)
+		}
+		var err error
+		if webhookTemplate, err = parseWebhookTemplate(*webhookTemplateText); err != nil {
+			slog.Error("invalid webhook-template", "err", err)
+			os.Exit(2)
+		}
+	default:
+		slog.Error("invalid target, expected slack, discord, teams or generic", "value", *target)
+		os.Exit(2)
+	}
+
+	for _, header := range headers.values {
+		name, value, err := parseHeader(header)
+		if err != nil {
+			slog.Error("invalid webhook-header", "err", err)
+			os.Exit(2)
+		}
+		webhookHeaders.Add(name, value)
+	}
+
+	if *slackFormat != "text" && *slackFormat != "blocks" && *slackFormat != "attachment" {
+		slog.Error("invalid slack-format, expected text, blocks or attachment", "value", *slackFormat)
+		os.Exit(2)
+	}
+
+	if location, err = time.LoadLocation(*timezone); err != nil {
+		slog.Error("invalid timezone", "value", *timezone, "err", err)
+		os.Exit(2)
+	}
+
+	source := *templateText
+	if source == "" {
+		source = defaultTemplate
+	}
+	if messageTemplate, err = template.New("message").Parse(source); err != nil {
+		slog.Error("invalid template", "err", err)
+		os.Exit(2)
+	}
+
+	if *batchWindow < 0 || *batchMax < 1 {
+		slog.Error("invalid batch settings, expected batch-window >= 0 and batch-max >= 1", "window", *batchWindow, "max", *batchMax)
+		os.Exit(2)
+	}
+
+	if *target == "discord" && *batchMax > discordEmbedLimit {
+		slog.Warn("discord messages hold at most 10 embeds, limiting batch-max", "value", *batchMax)
+		*batchMax = discordEmbedLimit
+	}
+
+	if *slackConcurrency < 1 || *slackRate < 0 {
+		slog.Error("invalid slack delivery settings, expected slack-concurrency >= 1 and slack-rate >= 0", "concurrency", *slackConcurrency, "rate", *slackRate)
+		os.Exit(2)
+	}
+
+	switch *ntfyTransport {
+	case "http":
+	case "ws":
+		if *pollInterval > 0 {
+			slog.Error("polling requires the http transport", "transport", *ntfyTransport)
+			os.Exit(2)
+		}
+	default:
+		slog.Error("invalid ntfy transport, expected http or ws", "transport", *ntfyTransport)
+		os.Exit(2)
+	}
+	if *reconnectMin <= 0 || *reconnectMax < *reconnectMin {
+		slog.Error("invalid reconnect delays, expected 0 < reconnect-min <= reconnect-max", "min", *reconnectMin, "max", *reconnectMax)
+		os.Exit(2)
+	}
+
+	if server, err := url.Parse(ntfyServerUrl()); err != nil || (server.Scheme != "http" && server.Scheme != "https") || server.Host == "" {
+		slog.Error("invalid ntfy-domain, expected a domain or a http(s) url", "value", *ntfyDomain)
+		os.Exit(2)
+	}
+
+	if ntfyClient, err = newNtfyClient(); err != nil {
+		slog.Error("invalid ntfy tls configuration", "err", err)
+		os.Exit(2)
+	}
+
+	if *dedupTtl > 0 {
+		dedup = newDedupCache(*dedupTtl)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	muxes := map[string]*http.ServeMux{}
+	if *healthAddr != "" {
+		muxes[*healthAddr] = http.NewServeMux()
+		registerHealthHandlers(muxes[*healthAddr])
+	}
+	if *metricsAddr != "" {
+		if muxes[*metricsAddr] == nil {
+			muxes[*metricsAddr] = http.NewServeMux()
+		}
+		registerMetricsHandler(muxes[*metricsAddr])
+	}
+	for addr, mux := range muxes {
+		if err := serve(addr, mux); err != nil {
+			slog.Error("error starting http server", "addr", addr, "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if *stateFile != "" {
+		loadState(*stateFile)
+	}
+
+	startDelivery(*slackConcurrency, *slackRate)
+	if *batchWindow > 0 {
+		messageBatcher = newBatcher(*batchWindow, *batchMax)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		subscribe(ctx)
+		if messageBatcher != nil {
+			messageBatcher.close()
+		}
+		stopDelivery()
+	}()
+
+	<-ctx.Done()
+	// a second signal kills the process right away
+	stop()
+	slog.Info("shutting down")
+
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		slog.Warn("timed out waiting for in-flight messages")
+	}
+}
+
+// subscribe keeps a subscription to ntfy running until ctx is cancelled,
+// reconnecting with an exponential backoff.
+func subscribe(ctx context.Context) {
+	delay := *reconnectMin
 	for {
-		if err := waitForNtfyMessage(); err != nil {
+		connected := time.Now()
+		err := waitForNtfyMessage(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
 			slog.Error("waitForNtfyMessage", "err", err)
-		} else {
+		} else if *pollInterval == 0 {
 			slog.Info("connection closed, restarting")
 		}
-		time.Sleep(30 * time.Second)
+
+		if *pollInterval > 0 && err == nil {
+			ready.Store(true)
+			delay = *reconnectMin
+			if !sleep(ctx, *pollInterval) {
+				return
+			}
+			continue
+		}
+
+		ready.Store(false)
+		metrics.reconnects.Add(1)
+		if time.Since(connected) >= stableConnection {
+			delay = *reconnectMin
+		}
+		slog.Debug("reconnecting", "delay", delay)
+		if !sleep(ctx, delay) {
+			return
+		}
+		delay = min(2*delay, *reconnectMax)
+	}
+}
+
+// sleep pauses for d, returning false if ctx was cancelled in the meantime.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// lookupEnvDuration returns the duration stored in the env var key, falling
+// back to fallback if it is unset or cannot be parsed.
+func lookupEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("ignoring invalid duration", "env", key, "value", value, "err", err)
+		return fallback
 	}
+	return duration
 }
 
-func waitForNtfyMessage() error {
-	client := &http.Client{}
-	req, err := http.NewRequest(
+// lookupEnvInt returns the integer stored in the env var key, falling back to
+// fallback if it is unset or cannot be parsed.
+func lookupEnvInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("ignoring invalid number", "env", key, "value", value, "err", err)
+		return fallback
+	}
+	return number
+}
+
+// lookupEnvFloat returns the number stored in the env var key, falling back
+// to fallback if it is unset or cannot be parsed.
+func lookupEnvFloat(key string, fallback float64) float64 {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		slog.Warn("ignoring invalid number", "env", key, "value", value, "err", err)
+		return fallback
+	}
+	return number
+}
+
+// lookupEnvBool returns the boolean stored in the env var key, falling back
+// to fallback if it is unset or cannot be parsed.
+func lookupEnvBool(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	boolean, err := strconv.ParseBool(value)
+	if err != nil {
+		slog.Warn("ignoring invalid boolean", "env", key, "value", value, "err", err)
+		return fallback
+	}
+	return boolean
+}
+
+// listFlag is a flag that can be passed multiple times, collecting all
+// values. Values passed on the command line replace the defaults from the
+// environment.
+type listFlag struct {
+	values []string
+	set    bool
+}
+
+func (l *listFlag) String() string {
+	return strings.Join(l.values, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	if !l.set {
+		l.values, l.set = nil, true
+	}
+	l.values = append(l.values, value)
+	return nil
+}
+
+// splitList turns a comma separated list, like topics, into its trimmed,
+// non-empty elements.
+func splitList(topics string) []string {
+	var result []string
+	for _, topic := range strings.Split(topics, ",") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			result = append(result, topic)
+		}
+	}
+	return result
+}
+
+// ntfyServerUrl returns the base url of the ntfy server. --ntfy-domain is
+// either a plain domain, which is served over https, or a full url.
+func ntfyServerUrl() string {
+	if strings.Contains(*ntfyDomain, "://") {
+		return strings.TrimSuffix(*ntfyDomain, "/")
+	}
+	return "https://" + *ntfyDomain
+}
+
+// newNtfyClient creates the http client used for the ntfy subscription,
+// applying --ntfy-insecure and --ntfy-ca-cert. The slack client is not
+// affected by these options.
+func newNtfyClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: *ntfyInsecure,
+	}
+	if *ntfyInsecure {
+		slog.Warn("tls certificate verification for ntfy is disabled")
+	}
+
+	if *ntfyCaCert != "" {
+		pem, err := os.ReadFile(*ntfyCaCert)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + *ntfyCaCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{
+		Transport: transport,
+	}, nil
+}
+
+// validateRequired checks that a topic and a usable webhook url are
+// configured, so a misconfigured deployment fails on startup rather than with
+// the first message.
+func validateRequired() error {
+	if len(ntfyTopics) == 0 {
+		return errors.New("no ntfy topic configured, set --ntfy-topic or NTFY_TOPIC")
+	}
+	if *slackWebhookUrl == "" {
+		return errors.New("no webhook url configured, set --slack-webhook or SLACK_WEBHOOK_URL")
+	}
+	if err := validateWebhookUrl(*slackWebhookUrl); err != nil {
+		return fmt.Errorf("invalid slack-webhook: %w", err)
+	}
+	for topic, webhookUrl := range slackRoutes {
+		if err := validateWebhookUrl(webhookUrl); err != nil {
+			return fmt.Errorf("invalid route for topic %s: %w", topic, err)
+		}
+	}
+	return nil
+}
+
+// validateWebhookUrl checks that webhookUrl is an absolute http or https url.
+func validateWebhookUrl(webhookUrl string) error {
+	parsed, err := url.Parse(webhookUrl)
+	if err != nil {
+		return errors.New("not a valid url")
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return errors.New("expected a http or https url")
+	}
+	if parsed.Host == "" {
+		return errors.New("url has no host")
+	}
+	return nil
+}
+
+// validateSince checks that since is one of the forms accepted by ntfy's
+// since parameter: empty, "all", a duration or a unix timestamp.
+func validateSince(since string) error {
+	if since == "" || since == "all" {
+		return nil
+	}
+	if _, err := strconv.ParseInt(since, 10, 64); err == nil {
+		return nil
+	}
+	if _, err := time.ParseDuration(since); err == nil {
+		return nil
+	}
+	return errors.New("expected all, a duration or a unix timestamp")
+}
+
+// subscriptionUrl builds the ntfy JSON stream url. Once a message has been
+// seen, the subscription resumes from its time, overriding --ntfy-since.
+//
+// In poll mode ntfy returns the cached messages and closes the connection,
+// so without an explicit since the first poll starts at process start to
+// match the streaming behaviour.
+func subscriptionUrl() string {
+	query := url.Values{}
+	if resume.time > 0 {
+		query.Set("since", strconv.FormatInt(resume.time, 10))
+	} else if *ntfySince != "" {
+		query.Set("since", *ntfySince)
+	} else if *pollInterval > 0 {
+		query.Set("since", strconv.FormatInt(startTime.Unix(), 10))
+	}
+	if *pollInterval > 0 {
+		query.Set("poll", "1")
+	}
+
+	endpoint := "/json"
+	if *ntfyTransport == "ws" {
+		endpoint = "/ws"
+	}
+
+	// ntfy subscribes to several topics at once via topic1,topic2/json.
+	subscription := ntfyServerUrl() + "/" + strings.Join(ntfyTopics, ",") + endpoint
+	if len(query) > 0 {
+		subscription += "?" + query.Encode()
+	}
+	return subscription
+}
+
+func waitForNtfyMessage(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(
+		ctx,
 		http.MethodGet,
-		"https://"+*ntfyDomain+"/"+*ntfyTopic+"/json",
+		subscriptionUrl(),
 		nil,
 	)
 	if err != nil {
 		slog.Error("error getting ntfy response", "err", err)
 		return err
 	}
-	if ntfyAuth != nil {
+	if *ntfyUser != "" || *ntfyPass != "" {
+		req.SetBasicAuth(*ntfyUser, *ntfyPass)
+	} else if ntfyAuth != nil {
 		req.Header.Add("Authorization", "Bearer "+*ntfyAuth)
 	}
+	var wsKey string
+	if *ntfyTransport == "ws" {
+		wsKey = upgradeWebSocket(req)
+	}
 
-	resp, err := client.Do(req)
+	resp, err := ntfyClient.Do(req)
 	if err != nil {
 		slog.Error("error connecting to ntfy server", "err", err)
 		return err
+	} else if wsKey != "" {
+		body, err := wrapWebSocket(ctx, resp, wsKey)
+		if err != nil {
+			resp.Body.Close()
+			slog.Error("error opening websocket", "err", err, "statusCode", strconv.FormatInt(int64(resp.StatusCode), 10))
+			return err
+		}
+		resp.Body = body
 	} else if resp.StatusCode != http.StatusOK {
 		slog.Error("invalid status code", "expected", http.StatusOK, "domain", *ntfyDomain, "statusCode", strconv.FormatInt(int64(resp.StatusCode), 10))
 		return errors.New("invalid response code from ntfy")
 	}
 	defer resp.Body.Close()
 
+	// A silently dropped connection never ends the scan below, so the body is
+	// closed if no line, keepalives included, arrives within the read timeout.
+	var timedOut atomic.Bool
+	var deadline *time.Timer
+	if *readTimeout > 0 {
+		deadline = time.AfterFunc(*readTimeout, func() {
+			timedOut.Store(true)
+			resp.Body.Close()
+		})
+		defer deadline.Stop()
+	}
+
 	scanner := bufio.NewScanner(resp.Body)
 	for scanner.Scan() {
+		if deadline != nil {
+			deadline.Reset(*readTimeout)
+		}
+
 		var msg ntfyMessage
 		err := json.Unmarshal([]byte(scanner.Text()), &msg)
 		if err != nil {
@@ -121,28 +821,41 @@ func waitForNtfyMessage() error {
 			continue
 		}
 
+		countReceived(msg.Event)
 		switch msg.Event {
 		case "open":
-			slog.Info("subscription established", "domain", *ntfyDomain)
+			ready.Store(true)
+			slog.Info("subscription established", "domain", *ntfyDomain, "topics", strings.Join(ntfyTopics, ","))
 			continue
 		case "keepalive":
 			slog.Debug("keepalive")
 			continue
 		case "message":
-			slog.Info("sending message", "title", msg.Title, "message", msg.Message)
-			if msg.Title != "" {
-				if err := sendToSlack(&slackMessage{
-					Text: "**" + msg.Title + "**: " + msg.Message,
-				}); err != nil {
-					slog.Error("error sending message", "err", err)
-				}
-			} else {
-				if err := sendToSlack(&slackMessage{
-					Text: msg.Message,
-				}); err != nil {
-					slog.Error("error sending message", "err", err)
-				}
+			if resume.seen(&msg) {
+				slog.Debug("skipping already forwarded message", "topic", msg.Topic, "id", msg.Id)
+				continue
+			}
+			resume.update(&msg)
+			if dedup != nil && dedup.check(msg.Id, time.Now()) {
+				slog.Debug("skipping duplicate message", "topic", msg.Topic, "id", msg.Id)
+				continue
+			}
+			if msg.Priority == 0 {
+				msg.Priority = defaultPriority
+			}
+			if msg.Time == 0 {
+				msg.Time = time.Now().Unix()
 			}
+			if reason := filterReason(&msg); reason != "" {
+				slog.Debug("dropping message", "topic", msg.Topic, "id", msg.Id, "reason", reason)
+				continue
+			}
+			slog.Info("sending message", "topic", msg.Topic, "title", msg.Title, "message", msg.Message, "priority", msg.Priority)
+			dispatch(delivery{
+				webhookUrl: webhookUrlFor(msg.Topic),
+				payload:    newPayload(&msg),
+				msgs:       []*ntfyMessage{&msg},
+			})
 			continue
 		default:
 			slog.Warn("bad message received", "message", scanner.Text())
@@ -150,52 +863,8 @@ func waitForNtfyMessage() error {
 		}
 	}
 
-	return nil
-}
-
-func sendToSlack(webhook *slackMessage) error {
-	if webhook == nil {
-		return errors.New("webhook undefined")
-	}
-
-	jsonBytes, err := json.Marshal(webhook)
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest(
-		http.MethodPost,
-		*slackWebhookUrl,
-		bytes.NewBuffer(jsonBytes),
-	)
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{
-		Timeout: 3 * time.Second,
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer func(Body io.ReadCloser) {
-		if err := Body.Close(); err != nil {
-			slog.Error("error closing response body", "err", err)
-		}
-	}(resp.Body)
-
-	if body, err := io.ReadAll(resp.Body); err != nil {
-		slog.Error("error parsing body", "err", err)
-		return err
-	} else {
-		slog.Debug("slack response", "status", resp.StatusCode, "body", body)
-	}
-
-	if resp.StatusCode >= 400 {
-		return errors.New("error status code " + strconv.FormatInt(int64(resp.StatusCode), 10))
+	if timedOut.Load() {
+		return errors.New("no data received from ntfy within " + readTimeout.String())
 	}
-
 	return nil
 }
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// slackHeaderLimit and slackSectionLimit are the maximum lengths of
+	// the text in the respective blocks.
+	slackHeaderLimit  = 150
+	slackSectionLimit = 3000
+	// slackContextLimit is the maximum number of elements in a context block.
+	slackContextLimit = 10
+	// maxRetryAfter caps how long a rate limited message waits for a retry.
+	maxRetryAfter = time.Minute
+	// defaultTemplate renders the title in bold in front of the message.
+	defaultTemplate = "{{if .Title}}*{{.Title}}*: {{end}}{{.Message}}"
+)
+
+// messageTemplate renders the text of a message, see --template.
+var messageTemplate *template.Template
+
+type slackMessage struct {
+	Text        string            `json:"text"`
+	Blocks      []slackBlock      `json:"blocks,omitempty"`
+	Attachments []slackAttachment `json:"attachments,omitempty"`
+	Channel     string            `json:"channel,omitempty"`
+	Username    string            `json:"username,omitempty"`
+	IconEmoji   string            `json:"icon_emoji,omitempty"`
+	IconUrl     string            `json:"icon_url,omitempty"`
+}
+
+// slackAttachment is a legacy message attachment, used for the color bar
+// next to the message.
+type slackAttachment struct {
+	Color    string `json:"color,omitempty"`
+	Text     string `json:"text"`
+	Fallback string `json:"fallback,omitempty"`
+}
+
+// slackBlock is a Block Kit block, only the fields of the block types used
+// for messages are included.
+type slackBlock struct {
+	Type     string            `json:"type"`
+	Text     *slackTextObject  `json:"text,omitempty"`
+	Elements []slackTextObject `json:"elements,omitempty"`
+	ImageUrl string            `json:"image_url,omitempty"`
+	AltText  string            `json:"alt_text,omitempty"`
+}
+
+type slackTextObject struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// slackContent holds the parts a ntfy message is rendered into, they are put
+// together according to --slack-format.
+type slackContent struct {
+	// indicator holds the priority indicator and emoji tags.
+	indicator string
+	title     string
+	// body is the message converted to mrkdwn.
+	body string
+	// line is body rendered with the message template.
+	line       string
+	attachment string
+	// image is set for image attachments slack can display inline.
+	image  *ntfyAttachment
+	footer []string
+	// sentAt is set with --timestamp, the blocks format shows the time of
+	// every message on its own.
+	sentAt string
+}
+
+func renderSlackContent(msg *ntfyMessage) slackContent {
+	content := slackContent{
+		title: msg.Title,
+		body:  escapeMrkdwn(msg.Message),
+	}
+	if msg.isMarkdown() {
+		content.body = markdownToMrkdwn(msg.Message)
+	}
+
+	// the template sees title and message the way they end up in slack
+	data := *msg
+	data.Title = escapeMrkdwn(msg.Title)
+	data.Message = content.body
+	var line strings.Builder
+	if err := messageTemplate.Execute(&line, &data); err != nil {
+		slog.Warn("error executing template, sending the plain message", "id", msg.Id, "err", err)
+		content.line = content.body
+	} else {
+		content.line = line.String()
+	}
+
+	switch {
+	case msg.Priority >= 4:
+		content.indicator = "🔴"
+	case msg.Priority <= 2:
+		content.indicator = "⚪"
+	}
+
+	if msg.Attachment != nil && msg.Attachment.Url != "" {
+		name := msg.Attachment.Name
+		if name == "" {
+			name = msg.Attachment.Url
+		}
+		content.attachment = "📎 <" + msg.Attachment.Url + "|" + name + ">"
+		// attachments on a protected ntfy server can't be opened, or
+		// unfurled by slack, without the token.
+		if *ntfyAuth != "" && strings.HasPrefix(msg.Attachment.Url, ntfyServerUrl()) {
+			content.attachment += " (may require ntfy authentication)"
+		} else if strings.HasPrefix(msg.Attachment.Type, "image/") {
+			content.image = msg.Attachment
+		}
+	}
+	if msg.Click != "" {
+		content.footer = append(content.footer, "<"+msg.Click+"|"+*clickLabel+">")
+	}
+
+	// slack incoming webhooks can't do interactivity, so view and http
+	// actions become plain links and broadcast actions are left out.
+	var actions []string
+	for _, action := range msg.Actions {
+		if (action.Action == "view" || action.Action == "http") && action.Url != "" {
+			actions = append(actions, "<"+action.Url+"|"+action.Label+">")
+		}
+	}
+	if len(actions) > 0 {
+		content.footer = append(content.footer, strings.Join(actions, " | "))
+	}
+
+	if *timestamp {
+		content.sentAt = "Sent at " + time.Unix(msg.Time, 0).In(location).Format("2006-01-02 15:04 MST")
+	}
+
+	if !*noTags {
+		var emojis, hashtags []string
+		for _, tag := range msg.Tags {
+			if _, ok := emojiTags[tag]; ok {
+				emojis = append(emojis, ":"+tag+":")
+			} else {
+				hashtags = append(hashtags, "#"+tag)
+			}
+		}
+		if len(emojis) > 0 {
+			content.indicator = strings.TrimSpace(content.indicator + " " + strings.Join(emojis, ""))
+		}
+		if len(hashtags) > 0 {
+			content.footer = append(content.footer, strings.Join(hashtags, " "))
+		}
+	}
+	return content
+}
+
+// text renders the content as a single mrkdwn text.
+func (c slackContent) text() string {
+	text := c.line
+	if c.indicator != "" {
+		text = c.indicator + " " + text
+	}
+
+	if footer := c.textFooter(); len(footer) > 0 {
+		text += "\n" + strings.Join(footer, "\n")
+	}
+	return text
+}
+
+// textFooter returns the lines shown below the message in the text and
+// attachment formats.
+func (c slackContent) textFooter() []string {
+	footer := c.footer
+	if c.attachment != "" {
+		footer = append([]string{c.attachment}, footer...)
+	}
+	if c.sentAt != "" {
+		footer = append(footer, c.sentAt)
+	}
+	return footer
+}
+
+// summary renders a one line version of the content, the title or the first
+// line of the message.
+func (c slackContent) summary() string {
+	summary := "*" + escapeMrkdwn(c.title) + "*"
+	if c.title == "" {
+		summary, _, _ = strings.Cut(c.body, "\n")
+	}
+	if c.indicator != "" {
+		summary = c.indicator + " " + summary
+	}
+	return summary
+}
+
+// attachments renders the content as a legacy attachment with a color bar
+// for the priority of msg.
+func (c slackContent) attachments(msg *ntfyMessage) []slackAttachment {
+	var color string
+	switch {
+	case msg.Priority >= 5:
+		color = "#d00000"
+	case msg.Priority == 4:
+		color = "#ff9900"
+	case msg.Priority <= 2:
+		color = "#999999"
+	}
+
+	text := c.body
+	if *templateText != "" {
+		text = c.line
+	}
+	if footer := c.textFooter(); len(footer) > 0 {
+		text += "\n" + strings.Join(footer, "\n")
+	}
+
+	return []slackAttachment{{
+		Color:    color,
+		Text:     text,
+		Fallback: c.text(),
+	}}
+}
+
+// blocks renders the content as a Block Kit layout: the title as header, the
+// message as section and links and metadata as context. A custom template
+// replaces both header and section.
+func (c slackContent) blocks(msg *ntfyMessage) []slackBlock {
+	var blocks []slackBlock
+	section := c.line
+	if *templateText == "" {
+		section = c.body
+		if c.title != "" {
+			blocks = append(blocks, slackBlock{
+				Type: "header",
+				Text: &slackTextObject{Type: "plain_text", Text: truncate(c.title, slackHeaderLimit)},
+			})
+		}
+	}
+
+	if c.indicator != "" {
+		section = c.indicator + " " + section
+	}
+	blocks = append(blocks, slackBlock{
+		Type: "section",
+		Text: &slackTextObject{Type: "mrkdwn", Text: truncate(section, slackSectionLimit)},
+	})
+
+	footer := c.footer
+	if c.image != nil {
+		blocks = append(blocks, slackBlock{
+			Type:     "image",
+			ImageUrl: c.image.Url,
+			AltText:  c.image.Name,
+		})
+	} else if c.attachment != "" {
+		footer = append([]string{c.attachment}, footer...)
+	}
+
+	footer = append(footer,
+		"Topic: "+escapeMrkdwn(msg.Topic),
+		"Priority: "+strconv.Itoa(msg.Priority),
+	)
+	// slack displays the date in the time zone of the reader, the
+	// configured one is only used for the fallback
+	fallback := time.Unix(msg.Time, 0).In(location).Format("2006-01-02 15:04 MST")
+	footer = append(footer, "<!date^"+strconv.FormatInt(msg.Time, 10)+"^{date_short_pretty} {time}|"+fallback+">")
+	context := slackBlock{Type: "context"}
+	for _, element := range footer[:min(len(footer), slackContextLimit)] {
+		context.Elements = append(context.Elements, slackTextObject{Type: "mrkdwn", Text: element})
+	}
+	return append(blocks, context)
+}
+
+// newSlackMessage builds the slack message for msg. The text is always set,
+// in blocks and attachment format slack uses it for notifications.
+func newSlackMessage(msg *ntfyMessage) *slackMessage {
+	webhook := &slackMessage{
+		Channel:   *slackChannel,
+		Username:  *slackUsername,
+		IconEmoji: *slackIconEmoji,
+		IconUrl:   *slackIconUrl,
+	}
+
+	content := renderSlackContent(msg)
+	switch *slackFormat {
+	case "blocks":
+		webhook.Text = content.text()
+		webhook.Blocks = content.blocks(msg)
+	case "attachment":
+		webhook.Text = content.summary()
+		webhook.Attachments = content.attachments(msg)
+	default:
+		webhook.Text = content.text()
+	}
+	return webhook
+}
+
+// truncate shortens text to at most limit runes, marking the cut with an
+// ellipsis.
+func truncate(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit-1]) + "…"
+}
+
+// webhookUrlFor returns the webhook url messages of topic are sent to, the
+// route for the topic or --slack-webhook if there is none.
+func webhookUrlFor(topic string) string {
+	if webhookUrl, ok := slackRoutes[topic]; ok {
+		return webhookUrl
+	}
+	return *slackWebhookUrl
+}
+
+// newPayload builds the webhook payload for msg in the format of --target.
+func newPayload(msg *ntfyMessage) any {
+	switch *target {
+	case "discord":
+		return newDiscordMessage(msg)
+	case "teams":
+		return newTeamsMessageCard(msg)
+	case "generic":
+		return newGenericBody(msg)
+	default:
+		return newSlackMessage(msg)
+	}
+}
+
+// sendToSlack posts webhook as json to webhookUrl. Despite its name it works
+// for all targets, they share the retry and error handling.
+func sendToSlack(webhookUrl string, webhook any) error {
+	if webhook == nil {
+		return errors.New("webhook undefined")
+	}
+
+	jsonBytes, err := json.Marshal(webhook)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		retryAfter, err := postToSlack(webhookUrl, jsonBytes)
+		if retryAfter == 0 || attempt > *slackRetries {
+			return err
+		}
+		slog.Warn("rate limited by slack, retrying", "delay", retryAfter, "attempt", attempt)
+		time.Sleep(retryAfter)
+	}
+}
+
+// postToSlack posts the json encoded message once. If slack rate limited the
+// request, the returned duration tells how long to wait before retrying.
+func postToSlack(webhookUrl string, jsonBytes []byte) (time.Duration, error) {
+	req, err := http.NewRequest(
+		http.MethodPost,
+		webhookUrl,
+		bytes.NewBuffer(jsonBytes),
+	)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if *target == "generic" {
+		for name, values := range webhookHeaders {
+			req.Header[name] = values
+		}
+	}
+
+	client := &http.Client{
+		Timeout: 3 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func(Body io.ReadCloser) {
+		if err := Body.Close(); err != nil {
+			slog.Error("error closing response body", "err", err)
+		}
+	}(resp.Body)
+
+	if body, err := io.ReadAll(resp.Body); err != nil {
+		slog.Error("error parsing body", "err", err)
+		return 0, err
+	} else {
+		slog.Debug("slack response", "status", resp.StatusCode, "body", body)
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return retryAfter(resp.Header.Get("Retry-After")), errors.New("rate limited")
+	}
+	if resp.StatusCode >= 400 {
+		return 0, errors.New("error status code " + strconv.FormatInt(int64(resp.StatusCode), 10))
+	}
+
+	return 0, nil
+}
+
+// retryAfter parses the Retry-After header, either in seconds or as a date.
+// The delay is capped at maxRetryAfter, so a retrying message can't block
+// the delivery of the following ones for long.
+func retryAfter(header string) time.Duration {
+	delay := time.Second
+	// discord sends fractions of seconds
+	if seconds, err := strconv.ParseFloat(header, 64); err == nil {
+		delay = time.Duration(seconds * float64(time.Second))
+	} else if date, err := http.ParseTime(header); err == nil {
+		delay = time.Until(date)
+	}
+	return max(time.Second, min(delay, maxRetryAfter))
+}
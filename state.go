@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// state is what --state-file stores about the last forwarded message.
+type state struct {
+	Time int64  `json:"time"`
+	Id   string `json:"id"`
+}
+
+var (
+	stateMu   sync.Mutex
+	lastState state
+)
+
+// loadState resumes the subscription from the message stored in path. A
+// missing, empty or corrupt state file leaves the subscription live.
+func loadState(path string) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	} else if err != nil {
+		slog.Warn("error reading state file, starting live", "path", path, "err", err)
+		return
+	}
+
+	var stored state
+	if err := json.Unmarshal(content, &stored); err != nil || stored.Time <= 0 {
+		slog.Warn("ignoring invalid state file, starting live", "path", path, "err", err)
+		return
+	}
+
+	lastState = stored
+	resume.time = stored.Time
+	resume.ids = map[string]struct{}{stored.Id: {}}
+	slog.Info("resuming from state file", "path", path, "time", stored.Time, "id", stored.Id)
+}
+
+// saveState stores msg as the last forwarded message unless a newer one was
+// stored already. The file is replaced atomically, so a crash leaves either
+// the old or the new state.
+func saveState(path string, msg *ntfyMessage) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if msg.Time < lastState.Time {
+		return
+	}
+	lastState = state{Time: msg.Time, Id: msg.Id}
+
+	content, err := json.Marshal(lastState)
+	if err != nil {
+		slog.Error("error encoding state", "err", err)
+		return
+	}
+	if err := writeFileAtomic(path, content); err != nil {
+		slog.Error("error writing state file", "path", path, "err", err)
+	}
+}
+
+// writeFileAtomic writes content to a temporary file next to path and
+// renames it over path.
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// teamsMessageCard is a legacy Office 365 connector card, which is what
+// Teams incoming webhooks accept.
+type teamsMessageCard struct {
+	Type            string         `json:"@type"`
+	Context         string         `json:"@context"`
+	Summary         string         `json:"summary"`
+	Title           string         `json:"title,omitempty"`
+	Text            string         `json:"text,omitempty"`
+	ThemeColor      string         `json:"themeColor,omitempty"`
+	Sections        []teamsSection `json:"sections,omitempty"`
+	PotentialAction []teamsAction  `json:"potentialAction,omitempty"`
+}
+
+type teamsSection struct {
+	ActivityTitle string `json:"activityTitle,omitempty"`
+	Text          string `json:"text"`
+}
+
+// teamsAction is an OpenUri action, shown as a button below the card.
+type teamsAction struct {
+	Type    string           `json:"@type"`
+	Name    string           `json:"name"`
+	Targets []teamsActionUri `json:"targets"`
+}
+
+type teamsActionUri struct {
+	Os  string `json:"os"`
+	Uri string `json:"uri"`
+}
+
+// teamsEscaper escapes the characters Teams uses for markdown formatting.
+var teamsEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"*", `\*`,
+	"_", `\_`,
+	"`", "\\`",
+	"#", `\#`,
+	"<", "&lt;",
+	">", "&gt;",
+)
+
+func newTeamsAction(name string, uri string) teamsAction {
+	return teamsAction{
+		Type:    "OpenUri",
+		Name:    name,
+		Targets: []teamsActionUri{{Os: "default", Uri: uri}},
+	}
+}
+
+// newTeamsMessageCard builds a Teams message card for msg with the ntfy title
+// as card title and the message as text. Click url, view and http actions and
+// attachments become buttons.
+func newTeamsMessageCard(msg *ntfyMessage) *teamsMessageCard {
+	text := teamsEscaper.Replace(msg.Message)
+	if msg.isMarkdown() {
+		text = msg.Message
+	}
+	// Teams joins single line breaks
+	text = strings.ReplaceAll(text, "\n", "\n\n")
+	if !*noTags && len(msg.Tags) > 0 {
+		text += "\n\n" + teamsEscaper.Replace("#"+strings.Join(msg.Tags, " #"))
+	}
+
+	card := &teamsMessageCard{
+		Type:    "MessageCard",
+		Context: "https://schema.org/extensions",
+		Summary: msg.Title,
+		Title:   teamsEscaper.Replace(msg.Title),
+		Text:    text,
+	}
+	if card.Summary == "" {
+		card.Summary = truncate(msg.Message, 100)
+	}
+	switch {
+	case msg.Priority >= 5:
+		card.ThemeColor = "d00000"
+	case msg.Priority == 4:
+		card.ThemeColor = "ff9900"
+	case msg.Priority <= 2:
+		card.ThemeColor = "999999"
+	}
+
+	if msg.Click != "" {
+		card.PotentialAction = append(card.PotentialAction, newTeamsAction(*clickLabel, msg.Click))
+	}
+	for _, action := range msg.Actions {
+		if (action.Action == "view" || action.Action == "http") && action.Url != "" {
+			card.PotentialAction = append(card.PotentialAction, newTeamsAction(action.Label, action.Url))
+		}
+	}
+	if msg.Attachment != nil && msg.Attachment.Url != "" {
+		card.PotentialAction = append(card.PotentialAction, newTeamsAction("📎 "+msg.Attachment.Name, msg.Attachment.Url))
+	}
+	return card
+}
+
+// mergeTeamsMessageCards combines cards into one card with a section per
+// card.
+func mergeTeamsMessageCards(cards []*teamsMessageCard) *teamsMessageCard {
+	merged := &teamsMessageCard{
+		Type:    "MessageCard",
+		Context: "https://schema.org/extensions",
+		Summary: strconv.Itoa(len(cards)) + " messages",
+	}
+	for _, card := range cards {
+		merged.Sections = append(merged.Sections, teamsSection{
+			ActivityTitle: card.Title,
+			Text:          card.Text,
+		})
+		merged.PotentialAction = append(merged.PotentialAction, card.PotentialAction...)
+		if merged.ThemeColor == "" || card.ThemeColor == "d00000" {
+			merged.ThemeColor = card.ThemeColor
+		}
+	}
+	return merged
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+)
+
+const (
+	// wsGuid is appended to the key of the handshake, see RFC 6455.
+	wsGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// wsMaxMessage bounds the memory used for a single message.
+	wsMaxMessage = 16 << 20
+
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// upgradeWebSocket prepares req for a websocket handshake and returns the key
+// the response has to confirm.
+func upgradeWebSocket(req *http.Request) string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	return key
+}
+
+// wrapWebSocket checks the handshake response and returns a body yielding
+// the received messages, each terminated by a newline, so the stream can be
+// consumed like ntfy's json stream. The transport no longer watches the
+// request context once the protocol switched, so the body is closed when ctx
+// is done instead.
+func wrapWebSocket(ctx context.Context, resp *http.Response, key string) (io.ReadCloser, error) {
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errors.New("websocket handshake failed")
+	}
+	accept := sha1.Sum([]byte(key + wsGuid))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		return nil, errors.New("websocket handshake returned an invalid accept key")
+	}
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return nil, errors.New("websocket connection is not writable")
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	return &wsReader{conn: conn, br: bufio.NewReader(conn), stop: stop}, nil
+}
+
+type wsReader struct {
+	conn    io.ReadWriteCloser
+	br      *bufio.Reader
+	stop    func() bool
+	pending []byte
+}
+
+func (r *wsReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		message, err := r.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		r.pending = append(message, '\n')
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *wsReader) Close() error {
+	r.stop()
+	return r.conn.Close()
+}
+
+// readMessage reads frames until a complete data message arrived, answering
+// pings on the way. A close frame ends the stream with io.EOF.
+func (r *wsReader) readMessage() ([]byte, error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := r.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsPing:
+			if err := r.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+		case wsPong:
+		case wsClose:
+			r.writeFrame(wsClose, nil)
+			return nil, io.EOF
+		case wsText, wsBinary, wsContinuation:
+			if len(message)+len(payload) > wsMaxMessage {
+				return nil, errors.New("websocket message too large")
+			}
+			message = append(message, payload...)
+			if fin {
+				return message, nil
+			}
+		default:
+			return nil, errors.New("unknown websocket opcode")
+		}
+	}
+}
+
+func (r *wsReader) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(r.br, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(r.br, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if length > wsMaxMessage {
+		return false, 0, nil, errors.New("websocket frame too large")
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r.br, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame writes a control frame, clients have to mask their frames.
+func (r *wsReader) writeFrame(opcode byte, payload []byte) error {
+	if len(payload) > 125 {
+		payload = payload[:125]
+	}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload)), 0, 0, 0, 0}
+	rand.Read(frame[2:6])
+	for i, b := range payload {
+		frame = append(frame, b^frame[2+i%4])
+	}
+	_, err := r.conn.Write(frame)
+	return err
+}
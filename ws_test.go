@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsFrame encodes an unmasked server frame.
+func wsFrame(fin bool, opcode byte, payload string) []byte {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	default:
+		frame = append(frame, 126, byte(len(payload)>>8), byte(len(payload)))
+	}
+	return append(frame, payload...)
+}
+
+// newWsServer upgrades every request and hands the connection to handle.
+// With a non-empty accept the handshake answers with that key instead of the
+// correct one.
+func newWsServer(t *testing.T, accept string, handle func(net.Conn, *bufio.ReadWriter)) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if accept == "" {
+			sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + wsGuid))
+			accept = base64.StdEncoding.EncodeToString(sum[:])
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n")
+		rw.Flush()
+		handle(conn, rw)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func dialWs(t *testing.T, ctx context.Context, url string) (io.ReadCloser, error) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := upgradeWebSocket(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := wrapWebSocket(ctx, resp, key)
+	if err != nil {
+		resp.Body.Close()
+	}
+	return body, err
+}
+
+func TestWebSocketFragmentedMessage(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	server := newWsServer(t, "", func(conn net.Conn, rw *bufio.ReadWriter) {
+		rw.Write(wsFrame(false, wsText, `{"id":`))
+		rw.Write(wsFrame(false, wsContinuation, `"a"`))
+		rw.Write(wsFrame(true, wsContinuation, `}`))
+		rw.Write(wsFrame(true, wsText, long))
+		rw.Write(wsFrame(true, wsClose, ""))
+		rw.Flush()
+	})
+
+	body, err := dialWs(t, context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+
+	got, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "{\"id\":\"a\"}\n" + long + "\n"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWebSocketPingIsAnsweredWithMaskedPong(t *testing.T) {
+	pong := make(chan []byte, 1)
+	server := newWsServer(t, "", func(conn net.Conn, rw *bufio.ReadWriter) {
+		rw.Write(wsFrame(true, wsPing, "hi"))
+		rw.Flush()
+
+		frame := make([]byte, 8)
+		if _, err := io.ReadFull(rw, frame); err != nil {
+			t.Error(err)
+		}
+		pong <- frame
+		rw.Write(wsFrame(true, wsClose, ""))
+		rw.Flush()
+	})
+
+	body, err := dialWs(t, context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	io.ReadAll(body)
+
+	frame := <-pong
+	if frame[0] != 0x80|wsPong {
+		t.Errorf("opcode byte = %#x, want a final pong", frame[0])
+	}
+	if frame[1] != 0x80|2 {
+		t.Errorf("length byte = %#x, want a masked payload of 2 bytes", frame[1])
+	}
+	payload := []byte{frame[6] ^ frame[2], frame[7] ^ frame[3]}
+	if string(payload) != "hi" {
+		t.Errorf("pong payload = %q, want %q", payload, "hi")
+	}
+}
+
+func TestWebSocketCloseEndsStream(t *testing.T) {
+	server := newWsServer(t, "", func(conn net.Conn, rw *bufio.ReadWriter) {
+		rw.Write(wsFrame(true, wsClose, ""))
+		rw.Write(wsFrame(true, wsText, "after close"))
+		rw.Flush()
+	})
+
+	body, err := dialWs(t, context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+
+	n, err := body.Read(make([]byte, 64))
+	if n != 0 || !errors.Is(err, io.EOF) {
+		t.Errorf("Read() = %d, %v, want 0, EOF", n, err)
+	}
+}
+
+func TestWebSocketRejectsBadAccept(t *testing.T) {
+	server := newWsServer(t, "bogus", func(net.Conn, *bufio.ReadWriter) {})
+
+	if _, err := dialWs(t, context.Background(), server.URL); err == nil {
+		t.Error("expected an error for an invalid Sec-WebSocket-Accept")
+	}
+}
+
+func TestWebSocketClosesOnCancel(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	server := newWsServer(t, "", func(net.Conn, *bufio.ReadWriter) {
+		<-done
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	body, err := dialWs(t, ctx, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := body.Read(make([]byte, 64))
+		read <- err
+	}()
+	cancel()
+
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Error("expected an error after cancelling")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read still blocked after the context was cancelled")
+	}
+}